@@ -0,0 +1,58 @@
+// Package backoff implements a small reusable exponential-backoff-with-
+// jitter helper shared by the gateway and endpoint reconnection
+// supervisors, so both sides retry PeerJS signaling/data-channel drops
+// the same way.
+package backoff
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Backoff produces successive retry delays that double on each call to
+// Next, up to Max, with full jitter applied so many concurrent retriers
+// don't thunder-herd the signaling server. It is safe for concurrent use.
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+
+	mu      sync.Mutex
+	attempt int
+}
+
+// New returns a Backoff starting at base and capped at max. A zero base
+// defaults to 20ms and a zero max defaults to 30s.
+func New(base, max time.Duration) *Backoff {
+	if base <= 0 {
+		base = 20 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	return &Backoff{Base: base, Max: max}
+}
+
+// Next returns the delay to wait before the next reconnect attempt and
+// advances the internal attempt counter. The delay doubles per attempt
+// (capped at Max) and is then scaled by a random factor in [0,1] (full
+// jitter) so retries spread out instead of bunching up.
+func (b *Backoff) Next() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d := b.Base << b.attempt
+	if d <= 0 || d > b.Max { // overflow or past the cap
+		d = b.Max
+	}
+	b.attempt++
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// Reset clears the attempt counter, e.g. after a successful reconnect.
+func (b *Backoff) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempt = 0
+}
@@ -0,0 +1,50 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext_DoublesAndCaps(t *testing.T) {
+	b := New(10*time.Millisecond, 100*time.Millisecond)
+
+	// Jitter makes each delay random in [0, bound], so assert on the
+	// upper bound doubling (and saturating at Max) rather than the
+	// returned value itself.
+	bounds := []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		80 * time.Millisecond,
+		100 * time.Millisecond, // capped: base<<4 would be 160ms
+		100 * time.Millisecond,
+	}
+	for i, bound := range bounds {
+		d := b.Next()
+		if d < 0 || d > bound {
+			t.Fatalf("attempt %d: Next() = %v, want in [0, %v]", i, d, bound)
+		}
+	}
+}
+
+func TestNext_ZeroValuesUseDefaults(t *testing.T) {
+	b := New(0, 0)
+	if b.Base != 20*time.Millisecond {
+		t.Errorf("Base = %v, want 20ms default", b.Base)
+	}
+	if b.Max != 30*time.Second {
+		t.Errorf("Max = %v, want 30s default", b.Max)
+	}
+}
+
+func TestReset_RestartsFromBase(t *testing.T) {
+	b := New(10*time.Millisecond, 100*time.Millisecond)
+	for i := 0; i < 5; i++ {
+		b.Next()
+	}
+	b.Reset()
+
+	if d := b.Next(); d > 10*time.Millisecond {
+		t.Fatalf("Next() after Reset = %v, want in [0, 10ms]", d)
+	}
+}
@@ -1,121 +1,126 @@
 // endpoint_peerjs.go
-package main
+package endpoint
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
-	"sort"
+	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	peerjs "github.com/muka/peerjs-go"
+
+	"restful_rtc/backoff"
+	"restful_rtc/protocol"
+	"restful_rtc/reverseproxy"
+	"restful_rtc/stats"
+	"restful_rtc/streambuf"
 )
 
 // --- SHARED STRUCTS ---
-// We define our new packet wrapper
-const (
-	PacketTypeRequest  = "request"
-	PacketTypeResponse = "response"
-	MaxChunkSize       = 16 * 1024 // 16KB chunks (well under the 64KB limit)
-)
 
-type Packet struct {
-	ID       string `json:"id"`       // The unique ID of the *full request/response*
-	Type     string `json:"type"`     // "request" or "response"
-	Sequence int    `json:"sequence"` // 0, 1, 2...
-	IsLast   bool   `json:"is_last"`
-	Payload  []byte `json:"payload"`
-}
+// requestStream is a request whose OPEN frame has arrived; its body
+// streams in afterwards via the streambuf.StreamBuffer.
+type requestStream struct {
+	header protocol.RequestHeader
+	body   *streambuf.StreamBuffer
 
-type ForwardedRequest struct {
-	ID      string      `json:"id"`
-	Method  string      `json:"method"`
-	Path    string      `json:"path"`
-	Query   string      `json:"query"`
-	Headers http.Header `json:"headers"`
-	Body    []byte      `json:"body"`
-}
-type ForwardedResponse struct {
-	ID         string      `json:"id"`
-	StatusCode int         `json:"status_code"`
-	Headers    http.Header `json:"headers"`
-	Body       []byte      `json:"body"`
+	createdAt time.Time
+	bytes     atomic.Int64
+	stats     *stats.Counters
 }
 
-// --- REASSEMBLER ---
-// For reassembling request packets
-type ReassemblyBuffer struct {
-	sync.Mutex
-	packets      map[int][]byte
-	lastSequence int
+// map[requestID] -> *requestStream
+var requestStreams sync.Map
+
+// StreamLimits bounds how long and how large a request stream may sit
+// waiting for its final frame before the janitor reclaims it, guarding
+// against memory growing without bound when a gateway disconnects
+// mid-upload, drops frames, or never sends the END/RST it owes. It
+// mirrors gateway.StreamLimits.
+type StreamLimits struct {
+	TTL      time.Duration
+	MaxBytes int64
 }
 
-func NewReassemblyBuffer() *ReassemblyBuffer {
-	return &ReassemblyBuffer{
-		packets:      make(map[int][]byte),
-		lastSequence: -1, // -1 means we haven't seen the last packet yet
-	}
+// DefaultStreamLimits matches the 60s / 32MB bounds used by both the
+// gateway and endpoint unless overridden.
+var DefaultStreamLimits = StreamLimits{
+	TTL:      60 * time.Second,
+	MaxBytes: 32 * 1024 * 1024,
 }
 
-// map[requestID] -> *ReassemblyBuffer
-var requestBuffers sync.Map
-
-// This is the target service you are forwarding to.
-const targetBaseURL = "http://localhost:8000"
-
-// --- STDIN HELPER ---
-func readFromStdin(prompt string) string {
-	fmt.Print(prompt)
-	reader := bufio.NewReader(os.Stdin)
-	text, _ := reader.ReadString('\n')
-	return strings.TrimSpace(text)
+// ReconnectPolicy configures the backoff used to redial the endpoint's
+// PeerJS signaling connection if it drops. It mirrors gateway.ReconnectPolicy.
+type ReconnectPolicy struct {
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxAttempts int // 0 means retry forever
 }
 
-// --- SPLITTER ---
-// sendSplitPacket handles chunking and sending our data
-func sendSplitPacket(dc *peerjs.DataConnection, requestID, packetType string, data []byte) error {
-	for i := 0; ; i++ {
-		start := i * MaxChunkSize
-		end := start + MaxChunkSize
-		isLast := false
-
-		if end >= len(data) {
-			end = len(data)
-			isLast = true
+// bodyReader adapts a streambuf.StreamBuffer into an io.Reader so it can
+// be handed straight to http.NewRequest as the outgoing request/response
+// body, without waiting for the whole body to arrive first.
+func bodyReader(sb *streambuf.StreamBuffer) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		for chunk := range sb.Chunks() {
+			if _, err := pw.Write(chunk); err != nil {
+				return
+			}
 		}
+		pw.CloseWithError(sb.Err())
+	}()
+	return pr
+}
 
-		packet := Packet{
-			ID:       requestID,
-			Type:     packetType,
-			Sequence: i,
-			IsLast:   isLast,
-			Payload:  data[start:end],
-		}
+// targetBaseURL is the service this endpoint forwards requests to, and
+// targetHost is its host[:port], used to rewrite the outgoing request's
+// Host header.
+var (
+	targetBaseURL string
+	targetHost    string
+	headerPolicy  reverseproxy.Policy
+)
 
-		packetBytes, err := json.Marshal(packet)
-		if err != nil {
-			return fmt.Errorf("failed to marshal packet: %v", err)
-		}
+// Server is a running endpoint: its PeerJS peer plus the bookkeeping
+// needed to drain in-flight requests on shutdown instead of cutting them
+// off mid-response.
+type Server struct {
+	peer *peerjs.Peer
 
-		// Send with chunking
-		if err := dc.Send(packetBytes, true); err != nil {
-			return fmt.Errorf("failed to send packet: %v", err)
-		}
+	wg       sync.WaitGroup // outstanding handleOpenedRequest goroutines
+	draining atomic.Bool    // true once Shutdown has stopped accepting new requests
+	done     chan struct{}
 
-		if isLast {
-			break
-		}
-	}
-	return nil
+	stats       *stats.Registry
+	adminServer *http.Server
+	limits      StreamLimits
+
+	stopJanitor context.CancelFunc
 }
 
-func main() {
+// NewServer registers a PeerJS peer under endpointID and wires it up to
+// accept connections from a gateway and forward every request it
+// receives to host. If the signaling connection drops, it is redialed
+// with exponential backoff per policy.
+// adminPort, if nonzero, starts a local HTTP listener exposing /stats so
+// operators can inspect per-gateway traffic counters without going
+// through the data channel itself. limits bounds how long and how large
+// a request stream may grow before the janitor reclaims it.
+func NewServer(endpointID, host string, policy ReconnectPolicy, headers reverseproxy.Policy, adminPort int, limits StreamLimits) (*Server, error) {
+	targetBaseURL = host
+	headerPolicy = headers
+	if u, err := url.Parse(host); err == nil {
+		targetHost = u.Host
+	}
+
 	opts := peerjs.NewOptions()
 	opts.Host = "peerjs.mikedev101.cc" // <-- IMPORTANT: Change this!
 	opts.Port = 443
@@ -123,157 +128,340 @@ func main() {
 	opts.Path = "/"
 	opts.Debug = 3
 
-	endpointID := readFromStdin("Enter the ID you want this endpoint to have: ")
-	if endpointID == "" {
-		log.Fatal("Endpoint ID cannot be empty.")
-	}
-
 	endpointPeer, err := peerjs.NewPeer(endpointID, opts)
 	if err != nil {
-		log.Fatal("Failed to create peer:", err)
+		return nil, fmt.Errorf("failed to create peer: %w", err)
 	}
-	defer endpointPeer.Close()
 
 	log.Printf("Endpoint peer created with ID: %s", endpointPeer.ID)
 	log.Println("Waiting for gateway to connect...")
 
-	endpointPeer.On("connection", func(data interface{}) {
-		conn := data.(*peerjs.DataConnection)
-		log.Printf("Gateway '%s' connected!", conn.GetPeerID())
-
-		conn.On("open", func(data interface{}) {
-			log.Println("Data channel open! Ready to receive requests.")
-		})
-
-		// ==========================================================
-		// 						REASSEMBLER (for Requests)
-		// ==========================================================
-		conn.On("data", func(data interface{}) {
-			var packet Packet
-			if err := json.Unmarshal(data.([]byte), &packet); err != nil {
-				log.Printf("Error unmarshaling packet: %v", err)
-				return
+	s := &Server{peer: endpointPeer, done: make(chan struct{}), stats: &stats.Registry{}, limits: limits}
+	s.wireConnectionHandler()
+	s.watchSignalingSocket(policy)
+
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	s.stopJanitor = stopJanitor
+	go s.janitor(janitorCtx)
+
+	if adminPort != 0 {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/stats", s.statsHandler)
+		s.adminServer = &http.Server{Addr: fmt.Sprintf(":%d", adminPort), Handler: mux}
+		go func() {
+			log.Printf("Starting admin HTTP server on http://localhost:%d", adminPort)
+			if err := s.adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Admin HTTP server error: %v", err)
 			}
+		}()
+	}
 
-			// We only care about "request" packets here
-			if packet.Type != PacketTypeRequest {
-				return
-			}
+	return s, nil
+}
 
-			// Get or create the buffer for this request ID
-			buf, _ := requestBuffers.LoadOrStore(packet.ID, NewReassemblyBuffer())
-			rb := buf.(*ReassemblyBuffer)
+// statsHandler exposes per-gateway traffic/latency/error counters.
+// ?format=prometheus renders Prometheus text exposition format instead
+// of the default JSON.
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("format") == "prometheus" {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.stats.WritePrometheus(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.stats.Snapshot()); err != nil {
+		http.Error(w, "Failed to encode stats snapshot", http.StatusInternalServerError)
+	}
+}
 
-			rb.Lock()
-			// Store the packet payload
-			rb.packets[packet.Sequence] = packet.Payload
-			if packet.IsLast {
-				rb.lastSequence = packet.Sequence
-			}
+// Run blocks until Shutdown completes.
+func (s *Server) Run() {
+	<-s.done
+}
 
-			// Check if we have all the packets
-			isComplete := rb.lastSequence != -1 && len(rb.packets) == rb.lastSequence+1
-			rb.Unlock()
+// Shutdown stops accepting new requests, waits for every outstanding
+// handleOpenedRequest goroutine to finish (or ctx to expire), and only
+// then closes the PeerJS peer so no response is cut off mid-flight.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.draining.Store(true)
+	s.stopJanitor()
 
-			if isComplete {
-				// --- We have all packets, reassemble them ---
-				log.Printf("Reassembled request for %s", packet.ID)
+	if s.adminServer != nil {
+		_ = s.adminServer.Shutdown(ctx)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		close(s.done)
+		return fmt.Errorf("drain timed out with requests still in flight")
+	}
 
-				// Sort the keys (sequence numbers)
-				keys := make([]int, 0, len(rb.packets))
-				for k := range rb.packets {
-					keys = append(keys, k)
-				}
-				sort.Ints(keys)
+	s.peer.Close()
+	close(s.done)
+	return nil
+}
 
-				// Concatenate the payloads in order
-				var fullRequestData bytes.Buffer
-				for _, k := range keys {
-					fullRequestData.Write(rb.packets[k])
-				}
+// wireConnectionHandler registers the "connection" handler that accepts
+// incoming gateway DataConnections; it's re-registered after every
+// signaling reconnect since PeerJS drops listeners along with the socket.
+func (s *Server) wireConnectionHandler() {
+	s.peer.On("connection", func(data interface{}) {
+		conn := data.(*peerjs.DataConnection)
+		log.Printf("Gateway '%s' connected!", conn.GetPeerID())
 
-				// Clean up the buffer
-				requestBuffers.Delete(packet.ID)
+		neg := protocol.NewNegotiation(protocol.LocalHandshake("endpoint/" + s.peer.ID))
+		st := s.stats.Get(conn.GetPeerID())
 
-				// Process the assembled request in a new goroutine
-				go handleAssembledRequest(fullRequestData.Bytes(), conn)
+		conn.On("open", func(data interface{}) {
+			log.Println("Data channel open! Sending handshake...")
+			if err := protocol.SendHello(conn, protocol.LocalHandshake("endpoint/"+s.peer.ID)); err != nil {
+				log.Printf("Failed to send handshake: %v", err)
 			}
 		})
+
+		// ==========================================================
+		// 					REASSEMBLER (for Requests)
+		// ==========================================================
+		conn.On("data", func(data interface{}) {
+			s.handleFrame(conn, neg, data.([]byte), st)
+		})
 		// ==========================================================
 	})
-
-	select {}
 }
 
-// handleAssembledRequest processes the reassembled request and sends back a split response
-func handleAssembledRequest(fullRequestData []byte, conn *peerjs.DataConnection) {
-	var req ForwardedRequest
-	if err := json.Unmarshal(fullRequestData, &req); err != nil {
-		log.Printf("Error unmarshaling full request: %v", err)
+// handleFrame dispatches an incoming request-direction frame to the
+// requestStream for its ID, creating one on OPEN. Handshake frames are
+// handled regardless of negotiation state; every other frame is dropped
+// until neg has been accepted. Once the server is draining, new OPEN
+// frames are refused so it stops picking up work it won't finish before
+// shutdown's drain timeout.
+func (s *Server) handleFrame(conn *peerjs.DataConnection, neg *protocol.Negotiation, data []byte, st *stats.Counters) {
+	var frame protocol.Frame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		log.Printf("Error unmarshaling frame: %v", err)
 		return
 	}
 
-	// 1. We got a request. Execute it.
-	log.Printf("Received request %s: %s %s", req.ID, req.Method, req.Path)
-	resp := executeRequest(req)
+	switch frame.Kind {
+	case protocol.FrameHello:
+		var remote protocol.Handshake
+		if err := json.Unmarshal(frame.Payload, &remote); err != nil {
+			log.Printf("Error unmarshaling handshake: %v", err)
+			return
+		}
+		neg.HandleHello(conn, remote)
+		return
+	case protocol.FrameHelloReject:
+		neg.HandleHelloReject(string(frame.Payload))
+		return
+	}
 
-	// ==========================================================
-	// 						SPLITTER (for Responses)
-	// ==========================================================
+	select {
+	case <-neg.Ready():
+		if !neg.Accepted() {
+			return // peer rejected our handshake; nothing more to process
+		}
+	default:
+		log.Printf("Dropping frame received before handshake completed")
+		return
+	}
 
-	// 2. Marshal the *ForwardedResponse*
-	respBytes, err := json.Marshal(resp)
-	if err != nil {
-		log.Printf("Error marshaling response: %v", err)
+	// We only care about request-direction frames here
+	if frame.Dir != protocol.DirRequest {
 		return
 	}
 
-	// 3. Send the response back as split packets
-	log.Printf("Sending response %s (%d bytes)", req.ID, len(respBytes))
-	if err := sendSplitPacket(conn, req.ID, PacketTypeResponse, respBytes); err != nil {
-		log.Printf("Error sending split response: %v", err)
+	st.PacketsReceived.Add(1)
+	st.BytesReceived.Add(uint64(len(frame.Payload)))
+
+	switch frame.Kind {
+	case protocol.FrameOpen:
+		if s.draining.Load() {
+			log.Printf("Dropping request %s: server is shutting down", frame.ID)
+			return
+		}
+		var hdr protocol.RequestHeader
+		if err := json.Unmarshal(frame.Payload, &hdr); err != nil {
+			log.Printf("Error unmarshaling request header: %v", err)
+			return
+		}
+		rs := &requestStream{header: hdr, body: streambuf.New(), createdAt: time.Now(), stats: st}
+		requestStreams.Store(frame.ID, rs)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			handleOpenedRequest(rs, conn, neg.ChunkSize(), st)
+		}()
+	case protocol.FrameData:
+		rs, ok := requestStreams.Load(frame.ID)
+		if !ok {
+			return
+		}
+		stream := rs.(*requestStream)
+		if stream.bytes.Add(int64(len(frame.Payload))) > s.limits.MaxBytes {
+			st.Errors.Add(1)
+			requestStreams.Delete(frame.ID)
+			stream.body.Reset(fmt.Errorf("request exceeded max buffered size of %d bytes", s.limits.MaxBytes))
+			log.Printf("request stream %s exceeded max size, evicting", frame.ID)
+			return
+		}
+		if err := stream.body.Push(frame.Sequence, frame.Payload); err != nil {
+			log.Printf("request stream %s: %v", frame.ID, err)
+		}
+		st.StreamDepth.Store(int64(stream.body.Pending()))
+	case protocol.FrameEnd:
+		if rs, ok := requestStreams.Load(frame.ID); ok {
+			rs.(*requestStream).body.End()
+		}
+	case protocol.FrameRst:
+		st.Errors.Add(1)
+		if rs, ok := requestStreams.Load(frame.ID); ok {
+			rs.(*requestStream).body.Reset(fmt.Errorf("%s", frame.Payload))
+		}
+	}
+}
+
+// watchSignalingSocket redials the endpoint's PeerJS signaling connection
+// if it disconnects or errors, re-registering the "connection" handler
+// PeerJS drops along with the socket. A dropped gateway DataConnection
+// needs no action here: the gateway owns reconnecting to us, and we'll
+// simply see a fresh "connection" event when it redials.
+func (s *Server) watchSignalingSocket(policy ReconnectPolicy) {
+	bo := backoff.New(policy.BaseDelay, policy.MaxDelay)
+	var attempts atomic.Int64
+
+	s.peer.On("open", func(data any) {
+		bo.Reset()
+		attempts.Store(0)
+	})
+	s.peer.On("disconnected", func(data any) {
+		if n := attempts.Add(1); policy.MaxAttempts > 0 && n > int64(policy.MaxAttempts) {
+			log.Printf("Giving up after %d signaling reconnect attempts", policy.MaxAttempts)
+			return
+		}
+		log.Println("Signaling socket disconnected, reconnecting...")
+		go func() {
+			time.Sleep(bo.Next())
+			s.peer.Reconnect()
+			s.wireConnectionHandler()
+		}()
+	})
+	s.peer.On("error", func(data any) {
+		log.Printf("Signaling socket error: %v", data)
+	})
+}
+
+// janitor periodically sweeps requestStreams, evicting ones that have
+// outlived s.limits.TTL, until ctx is done.
+func (s *Server) janitor(ctx context.Context) {
+	ticker := time.NewTicker(s.limits.TTL / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweepStreams()
+		}
 	}
-	// ==========================================================
 }
 
-// --- HTTP EXECUTION ---
-func executeRequest(req ForwardedRequest) ForwardedResponse {
+// sweepStreams evicts request streams older than s.limits.TTL. Unlike the
+// gateway side, there's no waiting HTTP handler to unblock here: the
+// request's own goroutine is already blocked reading rs.body via
+// bodyReader, so resetting the body with an error is enough to make it
+// give up.
+func (s *Server) sweepStreams() {
+	requestStreams.Range(func(key, value any) bool {
+		id := key.(string)
+		rs := value.(*requestStream)
+		if time.Since(rs.createdAt) < s.limits.TTL {
+			return true
+		}
+		requestStreams.Delete(id)
+		rs.stats.Errors.Add(1)
+		rs.body.Reset(fmt.Errorf("request stream evicted after exceeding TTL of %s", s.limits.TTL))
+		log.Printf("evicting request stream %s: exceeded TTL", id)
+		return true
+	})
+}
+
+// handleOpenedRequest executes the upstream request as soon as its
+// headers are known, streaming the body in via bodyReader so a large
+// upload doesn't need to finish before http.Client.Do starts sending it,
+// then streams the upstream response straight back out as it arrives.
+func handleOpenedRequest(rs *requestStream, conn *peerjs.DataConnection, chunkSize int, st *stats.Counters) {
+	defer requestStreams.Delete(rs.header.ID)
+
+	st.InFlight.Add(1)
+	defer st.InFlight.Add(-1)
+	start := time.Now()
+
+	req := rs.header
+	log.Printf("Received request %s: %s %s", req.ID, req.Method, req.Path)
+
 	url := targetBaseURL + req.Path
 	if req.Query != "" {
 		url += "?" + req.Query
 	}
 
-	clientReq, err := http.NewRequest(req.Method, url, bytes.NewReader(req.Body))
+	clientReq, err := http.NewRequest(req.Method, url, bodyReader(rs.body))
 	if err != nil {
-		return errorResponse(req.ID, 500, "Failed to create request")
+		st.Errors.Add(1)
+		sendErrorResponse(conn, req.ID, 500, "Failed to create request", chunkSize, st)
+		return
 	}
 	clientReq.Header = req.Headers
+	reverseproxy.PrepareEgress(clientReq, targetHost, headerPolicy)
 
 	client := &http.Client{}
 	clientResp, err := client.Do(clientReq)
 	if err != nil {
-		return errorResponse(req.ID, 502, "Failed to execute request")
+		st.Errors.Add(1)
+		sendErrorResponse(conn, req.ID, 502, "Failed to execute request", chunkSize, st)
+		return
 	}
 	defer clientResp.Body.Close()
 
-	respBody, err := io.ReadAll(clientResp.Body)
+	hdr := protocol.ResponseHeader{ID: req.ID, StatusCode: clientResp.StatusCode, Headers: clientResp.Header}
+	hdrBytes, err := json.Marshal(hdr)
 	if err != nil {
-		return errorResponse(req.ID, 500, "Failed to read response body")
+		log.Printf("Error marshaling response header for %s: %v", req.ID, err)
+		return
+	}
+	if err := protocol.SendFrame(conn, protocol.Frame{ID: req.ID, Dir: protocol.DirResponse, Kind: protocol.FrameOpen, Payload: hdrBytes}, st); err != nil {
+		log.Printf("Error sending response header for %s: %v", req.ID, err)
+		return
 	}
+	st.Latency.Observe(time.Since(start))
 
-	return ForwardedResponse{
-		ID:         req.ID,
-		StatusCode: clientResp.StatusCode,
-		Headers:    clientResp.Header,
-		Body:       respBody,
+	log.Printf("Streaming response %s", req.ID)
+	if err := protocol.StreamBody(conn, req.ID, protocol.DirResponse, clientResp.Body, chunkSize, st); err != nil {
+		log.Printf("Error streaming response %s body: %v", req.ID, err)
 	}
 }
 
-func errorResponse(id string, code int, message string) ForwardedResponse {
-	return ForwardedResponse{
-		ID:         id,
-		StatusCode: code,
-		Headers:    http.Header{"Content-Type": []string{"text/plain"}},
-		Body:       []byte(message),
+// sendErrorResponse sends a synthetic single-chunk error response when
+// we can't even reach the upstream service.
+func sendErrorResponse(conn *peerjs.DataConnection, id string, code int, message string, chunkSize int, st *stats.Counters) {
+	hdr := protocol.ResponseHeader{ID: id, StatusCode: code, Headers: http.Header{"Content-Type": []string{"text/plain"}}}
+	hdrBytes, err := json.Marshal(hdr)
+	if err != nil {
+		log.Printf("Error marshaling error response header for %s: %v", id, err)
+		return
+	}
+	if err := protocol.SendFrame(conn, protocol.Frame{ID: id, Dir: protocol.DirResponse, Kind: protocol.FrameOpen, Payload: hdrBytes}, st); err != nil {
+		log.Printf("Error sending error response header for %s: %v", id, err)
+		return
+	}
+	if err := protocol.StreamBody(conn, id, protocol.DirResponse, strings.NewReader(message), chunkSize, st); err != nil {
+		log.Printf("Error streaming error response %s: %v", id, err)
 	}
 }
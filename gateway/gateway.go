@@ -2,271 +2,778 @@
 package gateway
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	peerjs "github.com/muka/peerjs-go"
+
+	"restful_rtc/backoff"
+	"restful_rtc/protocol"
+	"restful_rtc/reverseproxy"
+	"restful_rtc/stats"
+	"restful_rtc/streambuf"
 )
 
-// --- SHARED STRUCTS ---
-// We define our new packet wrapper
+// --- ENDPOINT ---
+
+// Strategy picks which healthy Endpoint in a Pool should serve the next
+// incoming HTTP request.
+type Strategy string
+
 const (
-	PacketTypeRequest  = "request"
-	PacketTypeResponse = "response"
-	MaxChunkSize       = 16 * 1024 // 16KB chunks (well under the 64KB limit)
+	StrategyRandom        Strategy = "random"
+	StrategyRoundRobin    Strategy = "round-robin"
+	StrategyLeastInFlight Strategy = "least-in-flight"
 )
 
-type Packet struct {
-	ID       string `json:"id"`       // The unique ID of the *full request/response*
-	Type     string `json:"type"`     // "request" or "response"
-	Sequence int    `json:"sequence"` // 0, 1, 2...
-	IsLast   bool   `json:"is_last"`
-	Payload  []byte `json:"payload"`
+// responseStream is what a single outstanding request is waiting on: the
+// ResponseHeader arrives once (from the OPEN frame) and the body chunks
+// stream in afterwards via the streambuf.StreamBuffer. The StreamBuffer
+// is created up front, before the OPEN frame is even sent, so DATA
+// frames that race ahead of httpHandler reading the header channel are
+// never dropped.
+type responseStream struct {
+	header chan *protocol.ResponseHeader
+	body   *streambuf.StreamBuffer
+
+	createdAt time.Time
+	bytes     atomic.Int64
 }
 
-type ForwardedRequest struct {
-	ID      string      `json:"id"`
-	Method  string      `json:"method"`
-	Path    string      `json:"path"`
-	Query   string      `json:"query"`
-	Headers http.Header `json:"headers"`
-	Body    []byte      `json:"body"`
+func newResponseStream() *responseStream {
+	return &responseStream{header: make(chan *protocol.ResponseHeader, 1), body: streambuf.New(), createdAt: time.Now()}
 }
-type ForwardedResponse struct {
-	ID         string      `json:"id"`
-	StatusCode int         `json:"status_code"`
-	Headers    http.Header `json:"headers"`
-	Body       []byte      `json:"body"`
+
+// StreamLimits bounds how long and how large a response stream may sit
+// waiting for its final frame before the janitor reclaims it, guarding
+// against memory growing without bound when an endpoint disconnects
+// mid-response, drops frames, or never sends the END/RST it owes.
+type StreamLimits struct {
+	TTL      time.Duration
+	MaxBytes int64
 }
 
-// --- REASSEMBLER ---
-// For reassembling response packets
-type ReassemblyBuffer struct {
-	sync.Mutex
-	packets      map[int][]byte
-	lastSequence int
+// DefaultStreamLimits matches the 60s / 32MB bounds used by both the
+// gateway and endpoint unless overridden.
+var DefaultStreamLimits = StreamLimits{
+	TTL:      60 * time.Second,
+	MaxBytes: 32 * 1024 * 1024,
 }
 
-func NewReassemblyBuffer() *ReassemblyBuffer {
-	return &ReassemblyBuffer{
-		packets:      make(map[int][]byte),
-		lastSequence: -1, // -1 means we haven't seen the last packet yet
-	}
+// Endpoint owns everything the gateway needs to talk to a single upstream
+// endpoint peer: its data connection and the response streams for
+// requests we've sent it that are still waiting on a reply. This used to
+// be package-global state (responseBuffers, responseChannels,
+// dataConnection); now each Endpoint in the Pool has its own copy so one
+// misbehaving/dead peer can't corrupt another's in-flight traffic.
+type Endpoint struct {
+	ID string
+
+	connMu sync.RWMutex
+	conn   *peerjs.DataConnection
+	neg    *protocol.Negotiation // guarded by connMu, like conn: both are swapped together on every (re)dial
+
+	alive    atomic.Bool
+	inFlight atomic.Int64
+	backoff  *backoff.Backoff
+	stats    *stats.Counters
+	limits   StreamLimits
+
+	responseStreams sync.Map // map[requestID]*responseStream
 }
 
-// map[requestID] -> *ReassemblyBuffer
-var responseBuffers sync.Map
+func newEndpoint(id string, bo *backoff.Backoff, st *stats.Counters, limits StreamLimits) *Endpoint {
+	return &Endpoint{ID: id, backoff: bo, stats: st, limits: limits}
+}
 
-// map[requestID] -> chan *ForwardedResponse
-var responseChannels sync.Map
-var dataConnection *peerjs.DataConnection
+// getConn returns the endpoint's current data connection, which is
+// swapped out from under in-flight readers whenever the reconnect
+// supervisor re-dials.
+func (e *Endpoint) getConn() *peerjs.DataConnection {
+	e.connMu.RLock()
+	defer e.connMu.RUnlock()
+	return e.conn
+}
 
-// --- SPLITTER ---
-// sendSplitPacket handles chunking and sending our data
-func sendSplitPacket(dc *peerjs.DataConnection, requestID, packetType string, data []byte) error {
-	for i := 0; ; i++ {
-		start := i * MaxChunkSize
-		end := start + MaxChunkSize
-		isLast := false
+// getNeg returns the endpoint's current Negotiation, swapped out
+// alongside conn on every (re)dial.
+func (e *Endpoint) getNeg() *protocol.Negotiation {
+	e.connMu.RLock()
+	defer e.connMu.RUnlock()
+	return e.neg
+}
 
-		if end >= len(data) {
-			end = len(data)
-			isLast = true
+// failInFlight aborts every response stream still waiting on this
+// endpoint, so the blocked httpHandler goroutines unblock immediately
+// instead of waiting out the full request timeout after the connection
+// drops. Reset here can race a Push still blocked on a slow httpHandler
+// reading the body (the same hazard the stream TTL janitor has); it's
+// safe because streambuf.StreamBuffer.Push gives up its send cleanly
+// once the stream is closed instead of racing close() on its channel.
+func (e *Endpoint) failInFlight() {
+	e.responseStreams.Range(func(_, value any) bool {
+		rs := value.(*responseStream)
+		select {
+		case rs.header <- nil: // wake a handler still waiting on the header
+		default:
 		}
+		rs.body.Reset(fmt.Errorf("endpoint connection lost"))
+		return true
+	})
+}
 
-		packet := Packet{
-			ID:       requestID,
-			Type:     packetType,
-			Sequence: i,
-			IsLast:   isLast,
-			Payload:  data[start:end],
-		}
+// handleData dispatches an incoming frame to the response stream for its
+// request ID, replacing the old whole-body reassembly. Handshake frames
+// are handled regardless of negotiation state; every other frame is
+// dropped until negotiation has been accepted.
+func (e *Endpoint) handleData(data any) {
+	var frame protocol.Frame
+	if err := json.Unmarshal(data.([]byte), &frame); err != nil {
+		log.Printf("[%s] error unmarshaling frame: %v", e.ID, err)
+		return
+	}
 
-		packetBytes, err := json.Marshal(packet)
-		if err != nil {
-			return fmt.Errorf("failed to marshal packet: %v", err)
+	switch frame.Kind {
+	case protocol.FrameHello:
+		var remote protocol.Handshake
+		if err := json.Unmarshal(frame.Payload, &remote); err != nil {
+			log.Printf("[%s] error unmarshaling handshake: %v", e.ID, err)
+			return
 		}
+		neg := e.getNeg()
+		neg.HandleHello(e.getConn(), remote)
+		return
+	case protocol.FrameHelloReject:
+		e.getNeg().HandleHelloReject(string(frame.Payload))
+		return
+	}
 
-		// Send with chunking
-		if err := dc.Send(packetBytes, true); err != nil {
-			return fmt.Errorf("failed to send packet: %v", err)
+	neg := e.getNeg()
+	select {
+	case <-neg.Ready():
+		if !neg.Accepted() {
+			return // peer rejected our handshake; nothing more to process
 		}
+	default:
+		log.Printf("[%s] dropping frame received before handshake completed", e.ID)
+		return
+	}
 
-		if isLast {
-			break
+	// We only care about response-direction frames here
+	if frame.Dir != protocol.DirResponse {
+		return
+	}
+
+	e.stats.PacketsReceived.Add(1)
+	e.stats.BytesReceived.Add(uint64(len(frame.Payload)))
+
+	switch frame.Kind {
+	case protocol.FrameOpen:
+		var hdr protocol.ResponseHeader
+		if err := json.Unmarshal(frame.Payload, &hdr); err != nil {
+			log.Printf("[%s] error unmarshaling response header: %v", e.ID, err)
+			return
+		}
+		rs, _ := e.responseStreams.LoadOrStore(frame.ID, newResponseStream())
+		rs.(*responseStream).header <- &hdr
+	case protocol.FrameData:
+		rs, ok := e.responseStreams.Load(frame.ID)
+		if !ok {
+			return // no one is waiting on this response anymore
+		}
+		stream := rs.(*responseStream)
+		if stream.bytes.Add(int64(len(frame.Payload))) > e.limits.MaxBytes {
+			e.stats.Errors.Add(1)
+			e.responseStreams.Delete(frame.ID)
+			stream.body.Reset(fmt.Errorf("response exceeded max buffered size of %d bytes", e.limits.MaxBytes))
+			log.Printf("[%s] response stream %s exceeded max size, evicting", e.ID, frame.ID)
+			return
+		}
+		if err := stream.body.Push(frame.Sequence, frame.Payload); err != nil {
+			log.Printf("[%s] response stream %s: %v", e.ID, frame.ID, err)
+		}
+		e.stats.StreamDepth.Store(int64(stream.body.Pending()))
+	case protocol.FrameEnd:
+		if rs, ok := e.responseStreams.Load(frame.ID); ok {
+			rs.(*responseStream).body.End()
+		}
+	case protocol.FrameRst:
+		e.stats.Errors.Add(1)
+		if rs, ok := e.responseStreams.Load(frame.ID); ok {
+			rs.(*responseStream).body.Reset(fmt.Errorf("%s", frame.Payload))
 		}
 	}
-	return nil
 }
 
-func RunGateway(id string, port int) {
-	opts := peerjs.NewOptions()
-	opts.Host = "peerjs.mikedev101.cc" // <-- IMPORTANT: Change this!
-	opts.Port = 443
-	opts.Secure = true
-	opts.Path = "/"
-	opts.Debug = 3
+// --- POOL ---
+
+// Pool is the set of endpoint peers a gateway can forward requests to. It
+// replaces the old package-global singleton dataConnection and chooses a
+// healthy Endpoint per incoming HTTP request via a pluggable Strategy,
+// similar to how a service registry hands out a random candidate node
+// from service.Services.
+type Pool struct {
+	mu        sync.RWMutex
+	peer      *peerjs.Peer
+	clientID  string
+	endpoints map[string]*Endpoint
+	strategy  Strategy
+	rrCursor  uint64
+	reconnect ReconnectPolicy
+	headers   reverseproxy.Policy
+	stats     *stats.Registry
+	limits    StreamLimits
+}
 
-	endpoint_id, _ := uuid.NewUUID()
-	gatewayPeer, err := peerjs.NewPeer(endpoint_id.String(), opts)
-	if err != nil {
-		log.Fatal("Failed to create peer:", err)
+// ReconnectPolicy configures the backoff used by both the gateway and
+// endpoint reconnection supervisors.
+type ReconnectPolicy struct {
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxAttempts int // 0 means retry forever
+}
+
+// DefaultReconnectPolicy matches the base 20ms / cap 30s / double-per-
+// attempt scheme used for both endpoint and gateway reconnects.
+var DefaultReconnectPolicy = ReconnectPolicy{
+	BaseDelay: 20 * time.Millisecond,
+	MaxDelay:  30 * time.Second,
+}
+
+// NewPool creates an empty pool bound to gatewayPeer that will select
+// endpoints using strategy, reconnect dropped endpoints per policy,
+// rewrite forwarded request headers per headers, and evict response
+// streams that outlive limits. Endpoints are added with Add.
+func NewPool(gatewayPeer *peerjs.Peer, strategy Strategy, policy ReconnectPolicy, headers reverseproxy.Policy, limits StreamLimits) *Pool {
+	if strategy == "" {
+		strategy = StrategyRandom
 	}
-	defer gatewayPeer.Close()
-	log.Printf("Gateway peer created with ID: %s", gatewayPeer.ID)
+	return &Pool{
+		peer:      gatewayPeer,
+		clientID:  "gateway/" + gatewayPeer.ID,
+		endpoints: make(map[string]*Endpoint),
+		strategy:  strategy,
+		reconnect: policy,
+		headers:   headers,
+		stats:     &stats.Registry{},
+		limits:    limits,
+	}
+}
 
-	if id == "" {
-		log.Fatal("Endpoint ID cannot be empty.")
+// Add dials id and registers it in the pool. The endpoint starts out dead
+// and is marked alive once its handshake completes and is accepted; if the
+// connection later drops, a reconnection supervisor redials it with
+// exponential backoff until it reappears.
+func (p *Pool) Add(id string) (*Endpoint, error) {
+	p.mu.Lock()
+	if existing, ok := p.endpoints[id]; ok {
+		p.mu.Unlock()
+		return existing, nil
 	}
-	log.Printf("Attempting to connect to endpoint: %s", id)
+	p.mu.Unlock()
+
+	ep := newEndpoint(id, backoff.New(p.reconnect.BaseDelay, p.reconnect.MaxDelay), p.stats.Get(id), p.limits)
 
-	conn, err := gatewayPeer.Connect(id, nil)
+	p.mu.Lock()
+	p.endpoints[id] = ep
+	p.mu.Unlock()
+
+	if err := p.dial(ep); err != nil {
+		return nil, err
+	}
+	return ep, nil
+}
+
+// dial connects (or reconnects) ep and wires its event handlers.
+func (p *Pool) dial(ep *Endpoint) error {
+	conn, err := p.peer.Connect(ep.ID, nil)
 	if err != nil {
-		log.Fatal("Failed to connect:", err)
+		return fmt.Errorf("failed to connect to endpoint %s: %w", ep.ID, err)
 	}
-	dataConnection = conn
-	log.Println("Connection initiated...")
 
-	// ==========================================================
-	// 						REASSEMBLER (for Responses)
-	// ==========================================================
-	conn.On("data", func(data any) {
-		var packet Packet
-		if err := json.Unmarshal(data.([]byte), &packet); err != nil {
-			log.Printf("Error unmarshaling packet: %v", err)
-			return
+	neg := protocol.NewNegotiation(protocol.LocalHandshake(p.clientID))
+	ep.connMu.Lock()
+	ep.conn = conn
+	ep.neg = neg
+	ep.connMu.Unlock()
+
+	conn.On("open", func(data any) {
+		log.Printf("[%s] data channel open, sending handshake", ep.ID)
+		if err := protocol.SendHello(conn, protocol.LocalHandshake(p.clientID)); err != nil {
+			log.Printf("[%s] failed to send handshake: %v", ep.ID, err)
 		}
+	})
 
-		// We only care about "response" packets here
-		if packet.Type != PacketTypeResponse {
+	// The endpoint only becomes selectable once the handshake it's
+	// waiting on completes and was accepted by both sides.
+	go func(neg *protocol.Negotiation) {
+		<-neg.Ready()
+		if !neg.Accepted() {
 			return
 		}
+		ep.alive.Store(true)
+		ep.backoff.Reset()
+	}(neg)
+
+	conn.On("close", func(data any) {
+		log.Printf("[%s] data channel closed, reconnecting", ep.ID)
+		p.onDrop(ep)
+	})
+	conn.On("error", func(data any) {
+		log.Printf("[%s] data channel error: %v, reconnecting", ep.ID, data)
+		p.onDrop(ep)
+	})
+	conn.On("data", ep.handleData)
+
+	return nil
+}
 
-		// Get or create the buffer for this request ID
-		buf, _ := responseBuffers.LoadOrStore(packet.ID, NewReassemblyBuffer())
-		rb := buf.(*ReassemblyBuffer)
+// onDrop marks ep dead, fails any requests it still owes a response, and
+// kicks off a reconnection supervisor unless one is already running.
+func (p *Pool) onDrop(ep *Endpoint) {
+	if !ep.alive.CompareAndSwap(true, false) {
+		return // another event already triggered the supervisor
+	}
+	ep.failInFlight()
+	go p.reconnectEndpoint(ep)
+}
 
-		rb.Lock()
-		// Store the packet payload
-		rb.packets[packet.Sequence] = packet.Payload
-		if packet.IsLast {
-			rb.lastSequence = packet.Sequence
+// reconnectEndpoint redials ep with exponential backoff and jitter until
+// it comes back up or reconnect.MaxAttempts is exhausted.
+func (p *Pool) reconnectEndpoint(ep *Endpoint) {
+	for attempt := 1; p.reconnect.MaxAttempts == 0 || attempt <= p.reconnect.MaxAttempts; attempt++ {
+		delay := ep.backoff.Next()
+		log.Printf("[%s] reconnect attempt %d in %s", ep.ID, attempt, delay)
+		time.Sleep(delay)
+
+		if err := p.dial(ep); err != nil {
+			log.Printf("[%s] reconnect attempt %d failed: %v", ep.ID, attempt, err)
+			continue
 		}
+		return
+	}
+	log.Printf("[%s] giving up after %d reconnect attempts", ep.ID, p.reconnect.MaxAttempts)
+}
 
-		// Check if we have all the packets
-		isComplete := rb.lastSequence != -1 && len(rb.packets) == rb.lastSequence+1
-		rb.Unlock()
+var errNoHealthyEndpoints = fmt.Errorf("no healthy endpoints available")
 
-		if isComplete {
-			// --- We have all packets, reassemble them ---
-			log.Printf("Reassembled response for %s", packet.ID)
+// aliveEndpoints returns the current snapshot of endpoints considered
+// healthy, in stable ID order so round-robin cursor math is deterministic.
+func (p *Pool) aliveEndpoints() []*Endpoint {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 
-			// Sort the keys (sequence numbers)
-			keys := make([]int, 0, len(rb.packets))
-			for k := range rb.packets {
-				keys = append(keys, k)
-			}
-			sort.Ints(keys)
+	alive := make([]*Endpoint, 0, len(p.endpoints))
+	for _, ep := range p.endpoints {
+		if ep.alive.Load() {
+			alive = append(alive, ep)
+		}
+	}
+	sort.Slice(alive, func(i, j int) bool { return alive[i].ID < alive[j].ID })
+	return alive
+}
 
-			// Concatenate the payloads in order
-			var fullResponseData bytes.Buffer
-			for _, k := range keys {
-				fullResponseData.Write(rb.packets[k])
+// Select picks one healthy endpoint according to the pool's strategy.
+func (p *Pool) Select() (*Endpoint, error) {
+	candidates := p.aliveEndpoints()
+	if len(candidates) == 0 {
+		return nil, errNoHealthyEndpoints
+	}
+
+	switch p.strategy {
+	case StrategyRoundRobin:
+		idx := atomic.AddUint64(&p.rrCursor, 1)
+		return candidates[idx%uint64(len(candidates))], nil
+	case StrategyLeastInFlight:
+		best := candidates[0]
+		for _, ep := range candidates[1:] {
+			if ep.inFlight.Load() < best.inFlight.Load() {
+				best = ep
 			}
+		}
+		return best, nil
+	default: // StrategyRandom
+		return candidates[rand.Intn(len(candidates))], nil
+	}
+}
 
-			// Clean up the buffer
-			responseBuffers.Delete(packet.ID)
+// EndpointStatus is the JSON shape returned by the /__gateway/endpoints
+// admin route.
+type EndpointStatus struct {
+	ID       string `json:"id"`
+	Alive    bool   `json:"alive"`
+	InFlight int64  `json:"in_flight"`
+}
 
-			// Now, unmarshal the *full* response
-			var resp ForwardedResponse
-			if err := json.Unmarshal(fullResponseData.Bytes(), &resp); err != nil {
-				log.Printf("Error unmarshaling full response: %v", err)
-				return
-			}
+// Snapshot reports the status of every endpoint the pool knows about,
+// alive or not, for the admin route.
+func (p *Pool) Snapshot() []EndpointStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	out := make([]EndpointStatus, 0, len(p.endpoints))
+	for _, ep := range p.endpoints {
+		out = append(out, EndpointStatus{
+			ID:       ep.ID,
+			Alive:    ep.alive.Load(),
+			InFlight: ep.inFlight.Load(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// totalInFlight sums in-flight requests across every endpoint, alive or
+// not, so a drain can tell whether anything is still outstanding.
+func (p *Pool) totalInFlight() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var total int64
+	for _, ep := range p.endpoints {
+		total += ep.inFlight.Load()
+	}
+	return total
+}
 
-			// Find the waiting HTTP handler and send it the response
-			if ch, ok := responseChannels.Load(resp.ID); ok {
-				ch.(chan *ForwardedResponse) <- &resp
+// drain blocks until every endpoint's in-flight count reaches zero or ctx
+// is done, whichever comes first.
+func (p *Pool) drain(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if n := p.totalInFlight(); n == 0 {
+			return nil
+		} else if ctx.Err() != nil {
+			return fmt.Errorf("drain timed out with %d requests still in flight", n)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("drain timed out with %d requests still in flight", p.totalInFlight())
+		case <-ticker.C:
+		}
+	}
+}
+
+// janitor periodically sweeps every endpoint's response streams, evicting
+// ones that have outlived p.limits.TTL, until ctx is done.
+func (p *Pool) janitor(ctx context.Context) {
+	ticker := time.NewTicker(p.limits.TTL / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.sweepStreams()
+		}
+	}
+}
+
+// sweepStreams evicts response streams older than p.limits.TTL, resolving
+// each one's header channel with a synthetic 504 so the httpHandler
+// goroutine still waiting on it unblocks immediately instead of waiting
+// out the full request timeout.
+func (p *Pool) sweepStreams() {
+	p.mu.RLock()
+	endpoints := make([]*Endpoint, 0, len(p.endpoints))
+	for _, ep := range p.endpoints {
+		endpoints = append(endpoints, ep)
+	}
+	p.mu.RUnlock()
+
+	for _, ep := range endpoints {
+		ep.responseStreams.Range(func(key, value any) bool {
+			id := key.(string)
+			rs := value.(*responseStream)
+			if time.Since(rs.createdAt) < p.limits.TTL {
+				return true
 			}
+			ep.responseStreams.Delete(id)
+			ep.stats.Errors.Add(1)
+			select {
+			case rs.header <- &protocol.ResponseHeader{ID: id, StatusCode: http.StatusGatewayTimeout, Headers: http.Header{"Content-Type": {"text/plain"}}}:
+			default:
+			}
+			rs.body.Reset(fmt.Errorf("response stream evicted after exceeding TTL of %s", p.limits.TTL))
+			log.Printf("[%s] evicting response stream %s: exceeded TTL", ep.ID, id)
+			return true
+		})
+	}
+}
+
+// parseTargets turns the -target flag into a list of endpoint peer IDs. A
+// value starting with http:// or https:// is treated as a registry URL
+// returning a JSON array of peer IDs (mirroring the registry-style node
+// selection pattern where a directory hands back candidate nodes);
+// anything else is a comma-separated list of literal peer IDs.
+func parseTargets(target string) ([]string, error) {
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return nil, fmt.Errorf("target cannot be empty")
+	}
+
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		resp, err := http.Get(target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query registry %s: %w", target, err)
 		}
-	})
-	// ==========================================================
+		defer resp.Body.Close()
 
-	conn.On("open", func(data any) {
-		log.Println("Data channel open. Starting HTTP server on http://localhost:" + strconv.Itoa(port))
-		http.HandleFunc("/", httpHandler)
-		if err := http.ListenAndServe(":"+strconv.Itoa(port), nil); err != nil {
-			log.Printf("HTTP server error: %v", err)
+		var ids []string
+		if err := json.NewDecoder(resp.Body).Decode(&ids); err != nil {
+			return nil, fmt.Errorf("failed to decode registry response from %s: %w", target, err)
 		}
+		return ids, nil
+	}
+
+	ids := strings.Split(target, ",")
+	for i := range ids {
+		ids[i] = strings.TrimSpace(ids[i])
+	}
+	return ids, nil
+}
+
+// Gateway bundles the pieces a running gateway needs to shut down
+// cleanly: the HTTP server accepting forwarded requests, the pool that
+// tracks what's still in flight, and the PeerJS peer itself.
+type Gateway struct {
+	pool        *Pool
+	peer        *peerjs.Peer
+	server      *http.Server
+	stopJanitor context.CancelFunc
+}
+
+// NewGateway creates the gateway's PeerJS peer, dials every endpoint in
+// target, and builds (but does not start) the HTTP server that will
+// forward requests to the pool.
+func NewGateway(target string, port int, strategy Strategy, policy ReconnectPolicy, headers reverseproxy.Policy, limits StreamLimits) (*Gateway, error) {
+	opts := peerjs.NewOptions()
+	opts.Host = "peerjs.mikedev101.cc" // <-- IMPORTANT: Change this!
+	opts.Port = 443
+	opts.Secure = true
+	opts.Path = "/"
+	opts.Debug = 3
+
+	endpoint_id, _ := uuid.NewUUID()
+	gatewayPeer, err := peerjs.NewPeer(endpoint_id.String(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create peer: %w", err)
+	}
+	log.Printf("Gateway peer created with ID: %s", gatewayPeer.ID)
+	watchSignalingSocket(gatewayPeer, policy)
+
+	targets, err := parseTargets(target)
+	if err != nil {
+		gatewayPeer.Close()
+		return nil, err
+	}
+
+	pool := NewPool(gatewayPeer, strategy, policy, headers, limits)
+	for _, id := range targets {
+		log.Printf("Attempting to connect to endpoint: %s", id)
+		if _, err := pool.Add(id); err != nil {
+			log.Printf("Failed to add endpoint %s: %v", id, err)
+		}
+	}
+	log.Println("Connection(s) initiated...")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/__gateway/endpoints", pool.endpointsHandler)
+	mux.HandleFunc("/__gateway/stats", pool.statsHandler)
+	mux.HandleFunc("/", pool.httpHandler)
+
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	go pool.janitor(janitorCtx)
+
+	return &Gateway{
+		pool:        pool,
+		peer:        gatewayPeer,
+		server:      &http.Server{Addr: ":" + strconv.Itoa(port), Handler: mux},
+		stopJanitor: stopJanitor,
+	}, nil
+}
+
+// ListenAndServe serves forwarded HTTP requests until Shutdown is called,
+// at which point it returns http.ErrServerClosed.
+func (g *Gateway) ListenAndServe() error {
+	log.Println("Starting HTTP server on http://localhost" + g.server.Addr)
+	return g.server.ListenAndServe()
+}
+
+// Shutdown stops accepting new HTTP requests, waits for every endpoint's
+// in-flight forwarded requests to resolve (or ctx to expire), and only
+// then closes the PeerJS peer so no response is cut off mid-flight.
+func (g *Gateway) Shutdown(ctx context.Context) error {
+	g.stopJanitor()
+	if err := g.server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("http server shutdown: %w", err)
+	}
+	if err := g.pool.drain(ctx); err != nil {
+		return err
+	}
+	g.peer.Close()
+	return nil
+}
+
+// watchSignalingSocket redials the PeerJS signaling connection itself
+// (as opposed to a single endpoint's DataConnection) if it disconnects or
+// errors, using the same backoff policy as endpoint reconnects. Existing
+// DataConnections to endpoints are unaffected by a signaling drop; this
+// only protects the gateway's ability to dial *new* endpoints.
+func watchSignalingSocket(peer *peerjs.Peer, policy ReconnectPolicy) {
+	bo := backoff.New(policy.BaseDelay, policy.MaxDelay)
+
+	peer.On("open", func(data any) {
+		bo.Reset()
+	})
+	peer.On("disconnected", func(data any) {
+		log.Printf("Gateway signaling socket disconnected, reconnecting")
+		go func() {
+			time.Sleep(bo.Next())
+			peer.Reconnect()
+		}()
+	})
+	peer.On("error", func(data any) {
+		log.Printf("Gateway signaling socket error: %v", data)
 	})
+}
 
-	select {}
+// endpointsHandler exposes the pool's health/load state as JSON so
+// operators can see which endpoints are in rotation.
+func (p *Pool) endpointsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p.Snapshot()); err != nil {
+		http.Error(w, "Failed to encode endpoint snapshot", http.StatusInternalServerError)
+	}
 }
 
-func httpHandler(w http.ResponseWriter, r *http.Request) {
-	if dataConnection == nil {
-		http.Error(w, "Endpoint not connected", http.StatusServiceUnavailable)
+// statsHandler exposes per-endpoint traffic/latency/error counters.
+// ?format=prometheus renders Prometheus text exposition format instead
+// of the default JSON.
+func (p *Pool) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("format") == "prometheus" {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		p.stats.WritePrometheus(w)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p.stats.Snapshot()); err != nil {
+		http.Error(w, "Failed to encode stats snapshot", http.StatusInternalServerError)
+	}
+}
 
-	body, err := io.ReadAll(r.Body)
+func (p *Pool) httpHandler(w http.ResponseWriter, r *http.Request) {
+	ep, err := p.Select()
 	if err != nil {
-		http.Error(w, "Can't read body", http.StatusInternalServerError)
+		http.Error(w, "No healthy endpoints available", http.StatusServiceUnavailable)
 		return
 	}
-
-	// 1. Create the request struct
-	req := ForwardedRequest{
-		ID:      uuid.NewString(), // This ID is now critical
-		Method:  r.Method,
-		Path:    r.URL.Path,
-		Query:   r.URL.RawQuery,
-		Headers: r.Header,
-		Body:    body,
+	neg := ep.getNeg()
+	if !neg.Supports(protocol.FeatureStreamingBodies) {
+		http.Error(w, "Endpoint did not negotiate streaming-bodies support", http.StatusServiceUnavailable)
+		return
 	}
 
-	// 2. Create response channel to wait on
-	ch := make(chan *ForwardedResponse)
-	responseChannels.Store(req.ID, ch)
-	defer responseChannels.Delete(req.ID)
+	requestID := uuid.NewString() // This ID is now critical
+	start := time.Now()
+
+	rs := newResponseStream()
+	ep.responseStreams.Store(requestID, rs)
+	ep.inFlight.Add(1)
+	ep.stats.InFlight.Add(1)
+	defer func() {
+		ep.responseStreams.Delete(requestID)
+		ep.inFlight.Add(-1)
+		ep.stats.InFlight.Add(-1)
+	}()
 
 	// ==========================================================
-	// 						SPLITTER (for Requests)
+	// 					SPLITTER (for Requests)
 	// ==========================================================
 
-	// 3. Marshal the *ForwardedRequest* struct
-	reqBytes, err := json.Marshal(req)
+	// Strip hop-by-hop headers and stamp X-Forwarded-* before the
+	// request headers ever leave the gateway.
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	reverseproxy.PrepareIngress(r.Header, r.RemoteAddr, r.Host, proto, p.headers)
+
+	// 1. Send the OPEN frame with request metadata
+	hdr := protocol.RequestHeader{ID: requestID, Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Headers: r.Header}
+	hdrBytes, err := json.Marshal(hdr)
 	if err != nil {
-		http.Error(w, "Failed to marshal request", http.StatusInternalServerError)
+		http.Error(w, "Failed to marshal request header", http.StatusInternalServerError)
 		return
 	}
-
-	// 4. Send it as split packets
-	log.Printf("Sending request %s (%d bytes)", req.ID, len(reqBytes))
-	if err := sendSplitPacket(dataConnection, req.ID, PacketTypeRequest, reqBytes); err != nil {
+	conn := ep.getConn()
+	if err := protocol.SendFrame(conn, protocol.Frame{ID: requestID, Dir: protocol.DirRequest, Kind: protocol.FrameOpen, Payload: hdrBytes}, ep.stats); err != nil {
+		ep.stats.Errors.Add(1)
 		http.Error(w, "Failed to forward request", http.StatusInternalServerError)
 		return
 	}
+
+	// 2. Stream the request body as it's read, so a large upload doesn't
+	// have to finish before the endpoint starts seeing it. The upstream
+	// response can arrive before this finishes (e.g. an endpoint that
+	// replies before the whole upload lands), so it holds its own
+	// inFlight count rather than piggybacking on httpHandler's — otherwise
+	// drain could see totalInFlight hit zero and let Shutdown close the
+	// connection out from under a still-uploading body.
+	log.Printf("[%s] streaming request %s %s %s", ep.ID, requestID, r.Method, r.URL.Path)
+	ep.inFlight.Add(1)
+	go func() {
+		defer ep.inFlight.Add(-1)
+		if err := protocol.StreamBody(conn, requestID, protocol.DirRequest, r.Body, neg.ChunkSize(), ep.stats); err != nil {
+			log.Printf("[%s] error streaming request %s body: %v", ep.ID, requestID, err)
+		}
+	}()
 	// ==========================================================
 
-	// 5. Wait for the reassembled response (with a timeout)
+	// 3. Wait for the response header (with a timeout); the body then
+	// streams straight into w as frames arrive.
+	var hdrResp *protocol.ResponseHeader
 	select {
-	case resp := <-ch:
-		for k, v := range resp.Headers {
-			w.Header()[k] = v
+	case hdrResp = <-rs.header:
+		if hdrResp == nil {
+			ep.stats.Errors.Add(1)
+			http.Error(w, "Endpoint connection lost", http.StatusBadGateway)
+			return
 		}
-		w.WriteHeader(resp.StatusCode)
-		w.Write(resp.Body)
-	case <-time.After(30 * time.Second): // Increased timeout for chunking
+	case <-time.After(30 * time.Second):
+		ep.stats.Errors.Add(1)
 		http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+		return
+	}
+	ep.stats.Latency.Observe(time.Since(start))
+
+	reverseproxy.StripHopByHop(hdrResp.Headers)
+	for k, v := range hdrResp.Headers {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(hdrResp.StatusCode)
+
+	flusher, canFlush := w.(http.Flusher)
+	for chunk := range rs.body.Chunks() {
+		w.Write(chunk)
+		if canFlush {
+			flusher.Flush()
+		}
+	}
+	if err := rs.body.Err(); err != nil {
+		log.Printf("[%s] response %s ended with error: %v", ep.ID, requestID, err)
 	}
 }
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"restful_rtc/endpoint"
 	"restful_rtc/gateway"
+	"restful_rtc/reverseproxy"
 )
 
 func main() {
@@ -13,13 +20,28 @@ func main() {
 	// Example: go run main.go -mode=gateway
 	mode := flag.String("mode", "", "Run in 'gateway' or 'endpoint' mode")
 	id := flag.String("id", "", "Client ID for endpoint mode. Example: -id=your_endpoint_id")
-	target := flag.String("target", "", "Client ID to connect to in gateway mode. Example: -target=your_endpoint_id")
+	target := flag.String("target", "", "Client ID(s) to connect to in gateway mode: a comma-separated list of endpoint peer IDs, or an http(s):// registry URL returning a JSON array of peer IDs. Example: -target=endpoint-a,endpoint-b")
+	strategy := flag.String("strategy", "random", "Load-balancing strategy across the endpoint pool in gateway mode: 'random', 'round-robin', or 'least-in-flight'.")
 	host := flag.String("host", "", "Target server for endpoint mode. Example: http://localhost:8000.")
 	port := flag.Uint("port", 0, "Gateway server's host port. Example: http://localhost:8000, use -port=8000.")
+	reconnectBase := flag.Duration("reconnect-base", 20*time.Millisecond, "Base delay for the reconnection backoff, doubled on each failed attempt.")
+	reconnectMax := flag.Duration("reconnect-max", 30*time.Second, "Cap on the reconnection backoff delay.")
+	reconnectMaxAttempts := flag.Int("reconnect-max-attempts", 0, "Maximum reconnection attempts before giving up, 0 means retry forever.")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for in-flight requests to drain on SIGINT/SIGTERM before forcing an exit.")
+	preserveHost := flag.Bool("preserve-host", false, "Keep the original Host header on forwarded requests instead of rewriting it to the upstream target (endpoint mode only).")
+	via := flag.String("via", "", "If set, appended to the Via header on forwarded requests to identify this hop.")
+	adminPort := flag.Int("admin-port", 0, "If set, starts a local HTTP admin server on this port exposing /stats for per-gateway traffic counters (endpoint mode only).")
+	streamTTL := flag.Duration("stream-ttl", 60*time.Second, "How long an in-progress request/response body may sit unfinished before its reassembly buffer is evicted.")
+	streamMaxBytes := flag.Int64("stream-max-bytes", 32*1024*1024, "Maximum bytes a single request/response body may buffer during reassembly before it's evicted.")
 
 	// Parse the flags
 	flag.Parse()
 
+	headerPolicy := reverseproxy.Policy{PreserveHost: *preserveHost, Via: *via}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	// Run the appropriate function based on the flag
 	switch *mode {
 	case "gateway":
@@ -30,7 +52,18 @@ func main() {
 			log.Fatal("Error: You must specify a client ID to connect to. Example: -id=your_endpoint_id")
 		}
 		log.Println("Starting in Gateway mode...")
-		gateway.RunGateway(*target, int(*port))
+		policy := gateway.ReconnectPolicy{BaseDelay: *reconnectBase, MaxDelay: *reconnectMax, MaxAttempts: *reconnectMaxAttempts}
+		streamLimits := gateway.StreamLimits{TTL: *streamTTL, MaxBytes: *streamMaxBytes}
+		gw, err := gateway.NewGateway(*target, int(*port), gateway.Strategy(*strategy), policy, headerPolicy, streamLimits)
+		if err != nil {
+			log.Fatal(err)
+		}
+		runWithGracefulShutdown(ctx, *shutdownTimeout, func() error {
+			if err := gw.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		}, gw.Shutdown)
 	case "endpoint":
 		if *host == "" {
 			log.Fatal("Error: You must specify a host. Example: -host=http://localhost:8000")
@@ -39,8 +72,43 @@ func main() {
 			log.Fatal("Error: You must specify a client ID to create. Example: -id=your_endpoint_id")
 		}
 		log.Println("Starting in Endpoint mode...")
-		endpoint.RunEndpoint(*id, *host)
+		policy := endpoint.ReconnectPolicy{BaseDelay: *reconnectBase, MaxDelay: *reconnectMax, MaxAttempts: *reconnectMaxAttempts}
+		streamLimits := endpoint.StreamLimits{TTL: *streamTTL, MaxBytes: *streamMaxBytes}
+		srv, err := endpoint.NewServer(*id, *host, policy, headerPolicy, *adminPort, streamLimits)
+		if err != nil {
+			log.Fatal(err)
+		}
+		runWithGracefulShutdown(ctx, *shutdownTimeout, func() error {
+			srv.Run()
+			return nil
+		}, srv.Shutdown)
 	default:
 		log.Fatal("Error: You must specify a mode. Example: -mode=gateway or -mode=endpoint")
 	}
 }
+
+// runWithGracefulShutdown runs serve (which blocks until the server stops
+// accepting work) while a background goroutine waits for ctx to be
+// canceled (by SIGINT/SIGTERM) and then calls shutdown with a
+// timeout-bounded context to drain in-flight traffic. It waits for both
+// to finish before returning, so a drain failure's non-zero exit can't
+// race a clean process exit.
+func runWithGracefulShutdown(ctx context.Context, timeout time.Duration, serve func() error, shutdown func(context.Context) error) {
+	shutdownErr := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down, draining in-flight requests...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		shutdownErr <- shutdown(shutdownCtx)
+	}()
+
+	if err := serve(); err != nil {
+		log.Fatal("server error:", err)
+	}
+	if err := <-shutdownErr; err != nil {
+		log.Printf("Shutdown error: %v", err)
+		os.Exit(1)
+	}
+	log.Println("Shutdown complete")
+}
@@ -0,0 +1,178 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	peerjs "github.com/muka/peerjs-go"
+)
+
+// ProtocolVersion is bumped whenever the Frame wire format changes in a
+// way that isn't backwards compatible. Peers that disagree on the major
+// version are rejected outright rather than guessing at compatibility.
+const ProtocolVersion = 1
+
+// Feature names both sides can advertise support for in a Handshake.
+// Only FeatureStreamingBodies is actually implemented today; the others
+// are reserved so future packet variants can be gated the same way.
+const (
+	FeatureStreamingBodies = "streaming-bodies"
+	FeatureGzip            = "gzip"
+	FeatureTrailers        = "trailers"
+	FeatureHTTP2Semantics  = "http2-semantics"
+)
+
+// SupportedFeatures is what this build advertises.
+var SupportedFeatures = []string{FeatureStreamingBodies}
+
+// FrameHello and FrameHelloReject are control frames exchanged once per
+// connection, before any request/response traffic is accepted. They
+// reuse the Frame envelope but only populate Kind and Payload.
+const (
+	FrameHello       = "hello"
+	FrameHelloReject = "hello_reject"
+)
+
+// Handshake is exchanged by both sides right after the data channel
+// opens, carrying the protocol version, the feature set this side
+// supports, the largest chunk it's willing to receive, and an identity
+// string for logging.
+type Handshake struct {
+	Version      int      `json:"version"`
+	Features     []string `json:"features"`
+	MaxChunkSize int      `json:"max_chunk_size"`
+	ClientID     string   `json:"client_id"`
+}
+
+// LocalHandshake builds the Handshake this side advertises, identifying
+// itself as clientID (e.g. "gateway/<peer-id>" or "endpoint/<peer-id>").
+func LocalHandshake(clientID string) Handshake {
+	return Handshake{
+		Version:      ProtocolVersion,
+		Features:     SupportedFeatures,
+		MaxChunkSize: MaxChunkSize,
+		ClientID:     clientID,
+	}
+}
+
+// Negotiation is the small state machine gating conn.On("data", ...)
+// until both sides have exchanged and accepted a Handshake. Once ready
+// is closed, Features/ChunkSize hold the negotiated intersection/min.
+type Negotiation struct {
+	mu       sync.Mutex
+	local    Handshake
+	ready    chan struct{}
+	accepted bool
+	features map[string]bool
+
+	chunkSize int
+}
+
+// NewNegotiation starts a Negotiation that will advertise local as this
+// side's Handshake once a peer is ready to receive it.
+func NewNegotiation(local Handshake) *Negotiation {
+	return &Negotiation{local: local, ready: make(chan struct{}), chunkSize: local.MaxChunkSize}
+}
+
+// Supports reports whether the negotiated feature set includes feature.
+// It blocks until negotiation completes.
+func (n *Negotiation) Supports(feature string) bool {
+	<-n.ready
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.features[feature]
+}
+
+// ChunkSize returns the negotiated max chunk size (the smaller of the
+// two sides' limits). It blocks until negotiation completes.
+func (n *Negotiation) ChunkSize() int {
+	<-n.ready
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.chunkSize
+}
+
+// Ready returns a channel closed once negotiation has completed
+// (accepted or rejected).
+func (n *Negotiation) Ready() <-chan struct{} {
+	return n.ready
+}
+
+// Accepted reports whether the remote handshake was compatible. Only
+// meaningful after Ready() is closed.
+func (n *Negotiation) Accepted() bool {
+	<-n.ready
+	return n.accepted
+}
+
+// HandleHello processes the peer's Handshake: rejects an incompatible
+// major version, otherwise computes the feature intersection and the
+// min chunk size and marks the negotiation ready.
+func (n *Negotiation) HandleHello(conn *peerjs.DataConnection, remote Handshake) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	select {
+	case <-n.ready:
+		return // already negotiated (accepted or rejected)
+	default:
+	}
+
+	if remote.Version != n.local.Version {
+		reason := fmt.Sprintf("protocol version mismatch: local=%d remote=%d", n.local.Version, remote.Version)
+		log.Printf("[%s] rejecting handshake: %s", remote.ClientID, reason)
+		_ = SendFrame(conn, Frame{Kind: FrameHelloReject, Payload: []byte(reason)}, nil)
+		close(n.ready)
+		return
+	}
+
+	remoteSet := make(map[string]bool, len(remote.Features))
+	for _, f := range remote.Features {
+		remoteSet[f] = true
+	}
+	features := make(map[string]bool)
+	for _, f := range n.local.Features {
+		if remoteSet[f] {
+			features[f] = true
+		}
+	}
+
+	chunkSize := n.local.MaxChunkSize
+	if remote.MaxChunkSize > 0 && remote.MaxChunkSize < chunkSize {
+		chunkSize = remote.MaxChunkSize
+	}
+
+	n.features = features
+	n.chunkSize = chunkSize
+	n.accepted = true
+	log.Printf("[%s] handshake accepted: features=%v chunk_size=%d", remote.ClientID, features, chunkSize)
+	close(n.ready)
+}
+
+// HandleHelloReject records that the remote side rejected our Handshake
+// (e.g. a protocol version it doesn't understand).
+func (n *Negotiation) HandleHelloReject(reason string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.accepted {
+		return
+	}
+	log.Printf("handshake rejected by peer: %s", reason)
+	select {
+	case <-n.ready:
+	default:
+		close(n.ready)
+	}
+}
+
+// SendHello sends our Handshake as the first frame on a freshly opened
+// connection.
+func SendHello(conn *peerjs.DataConnection, local Handshake) error {
+	payload, err := json.Marshal(local)
+	if err != nil {
+		return fmt.Errorf("failed to marshal handshake: %w", err)
+	}
+	return SendFrame(conn, Frame{Kind: FrameHello, Payload: payload}, nil)
+}
@@ -0,0 +1,73 @@
+package protocol
+
+import "testing"
+
+func TestLocalHandshake(t *testing.T) {
+	h := LocalHandshake("gateway/abc123")
+	if h.Version != ProtocolVersion {
+		t.Errorf("Version = %d, want %d", h.Version, ProtocolVersion)
+	}
+	if h.MaxChunkSize != MaxChunkSize {
+		t.Errorf("MaxChunkSize = %d, want %d", h.MaxChunkSize, MaxChunkSize)
+	}
+	if h.ClientID != "gateway/abc123" {
+		t.Errorf("ClientID = %q, want %q", h.ClientID, "gateway/abc123")
+	}
+}
+
+func TestHandleHello_AcceptsMatchingVersionAndIntersectsFeatures(t *testing.T) {
+	local := Handshake{Version: ProtocolVersion, Features: []string{FeatureStreamingBodies, FeatureGzip}, MaxChunkSize: 4096, ClientID: "gateway/local"}
+	n := NewNegotiation(local)
+
+	remote := Handshake{Version: ProtocolVersion, Features: []string{FeatureStreamingBodies, FeatureTrailers}, MaxChunkSize: 2048, ClientID: "endpoint/remote"}
+	n.HandleHello(nil, remote)
+
+	select {
+	case <-n.Ready():
+	default:
+		t.Fatal("Ready() should be closed once a compatible handshake is handled")
+	}
+	if !n.Accepted() {
+		t.Fatal("Accepted() = false, want true for matching versions")
+	}
+	if !n.Supports(FeatureStreamingBodies) {
+		t.Error("Supports(FeatureStreamingBodies) = false, want true (present on both sides)")
+	}
+	if n.Supports(FeatureGzip) {
+		t.Error("Supports(FeatureGzip) = true, want false (local-only feature)")
+	}
+	if n.Supports(FeatureTrailers) {
+		t.Error("Supports(FeatureTrailers) = true, want false (remote-only feature)")
+	}
+	if got := n.ChunkSize(); got != 2048 {
+		t.Errorf("ChunkSize() = %d, want 2048 (the smaller of the two sides)", got)
+	}
+}
+
+func TestHandleHello_IgnoresSecondHandshake(t *testing.T) {
+	local := Handshake{Version: ProtocolVersion, Features: []string{FeatureStreamingBodies}, MaxChunkSize: 4096, ClientID: "gateway/local"}
+	n := NewNegotiation(local)
+
+	n.HandleHello(nil, Handshake{Version: ProtocolVersion, Features: []string{FeatureStreamingBodies}, MaxChunkSize: 1024, ClientID: "endpoint/a"})
+	n.HandleHello(nil, Handshake{Version: ProtocolVersion, Features: nil, MaxChunkSize: 9999, ClientID: "endpoint/b"})
+
+	if got := n.ChunkSize(); got != 1024 {
+		t.Errorf("ChunkSize() = %d, want 1024 from the first handshake (second should be ignored)", got)
+	}
+}
+
+func TestHandleHelloReject(t *testing.T) {
+	local := Handshake{Version: ProtocolVersion, Features: SupportedFeatures, MaxChunkSize: MaxChunkSize, ClientID: "gateway/local"}
+	n := NewNegotiation(local)
+
+	n.HandleHelloReject("protocol version mismatch: local=1 remote=2")
+
+	select {
+	case <-n.Ready():
+	default:
+		t.Fatal("Ready() should be closed once the peer rejects our handshake")
+	}
+	if n.Accepted() {
+		t.Fatal("Accepted() = true, want false after HandleHelloReject")
+	}
+}
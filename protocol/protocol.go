@@ -0,0 +1,105 @@
+// Package protocol is the wire protocol shared by the gateway and
+// endpoint: the framed request/response envelope and the handshake that
+// negotiates feature/chunk-size compatibility before either side trusts
+// the other's frames. Both packages used to carry their own byte-for-byte
+// copy of this file; that drifted the moment one side needed a change the
+// other didn't get, so it's factored out here the same way backoff,
+// reverseproxy, stats, and streambuf already are.
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	peerjs "github.com/muka/peerjs-go"
+
+	"restful_rtc/stats"
+)
+
+// A request/response doesn't travel as one fully-buffered blob: an OPEN
+// frame carries the metadata (method/path/headers or status/headers),
+// then the body streams as ordered DATA frames, terminated by END
+// (clean) or RST (aborted). This lets the endpoint start executing an
+// upstream request before an upload finishes, and lets the gateway start
+// writing a response before a download finishes.
+const (
+	DirRequest  = "request"
+	DirResponse = "response"
+
+	FrameOpen = "open"
+	FrameData = "data"
+	FrameEnd  = "end"
+	FrameRst  = "rst"
+
+	MaxChunkSize = 16 * 1024 // 16KB chunks (well under the 64KB limit)
+)
+
+type Frame struct {
+	ID       string `json:"id"`   // The unique ID of the request/response stream
+	Dir      string `json:"dir"`  // DirRequest or DirResponse
+	Kind     string `json:"kind"` // FrameOpen, FrameData, FrameEnd, or FrameRst
+	Sequence int    `json:"sequence,omitempty"`
+	Payload  []byte `json:"payload,omitempty"`
+}
+
+// RequestHeader is the OPEN-frame payload for a request stream.
+type RequestHeader struct {
+	ID      string      `json:"id"`
+	Method  string      `json:"method"`
+	Path    string      `json:"path"`
+	Query   string      `json:"query"`
+	Headers http.Header `json:"headers"`
+}
+
+// ResponseHeader is the OPEN-frame payload for a response stream.
+type ResponseHeader struct {
+	ID         string      `json:"id"`
+	StatusCode int         `json:"status_code"`
+	Headers    http.Header `json:"headers"`
+}
+
+// SendFrame marshals and sends a single control/data frame, recording it
+// against st if given (st is nil for connection-setup frames like the
+// handshake, which aren't peer traffic worth counting).
+func SendFrame(dc *peerjs.DataConnection, frame Frame, st *stats.Counters) error {
+	frameBytes, err := json.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("failed to marshal frame: %v", err)
+	}
+	if err := dc.Send(frameBytes, true); err != nil {
+		return fmt.Errorf("failed to send frame: %v", err)
+	}
+	if st != nil {
+		st.PacketsSent.Add(1)
+		st.BytesSent.Add(uint64(len(frame.Payload)))
+	}
+	return nil
+}
+
+// StreamBody reads body in chunkSize pieces and sends each as a DATA
+// frame, followed by an END frame on clean EOF or an RST frame if
+// reading body fails partway through. chunkSize should be the
+// handshake-negotiated size so neither side ever sends a chunk the
+// other didn't agree to receive.
+func StreamBody(dc *peerjs.DataConnection, id, dir string, body io.Reader, chunkSize int, st *stats.Counters) error {
+	buf := make([]byte, chunkSize)
+	seq := 0
+	for {
+		n, rerr := body.Read(buf)
+		if n > 0 {
+			if err := SendFrame(dc, Frame{ID: id, Dir: dir, Kind: FrameData, Sequence: seq, Payload: append([]byte(nil), buf[:n]...)}, st); err != nil {
+				return err
+			}
+			seq++
+		}
+		if rerr == io.EOF {
+			return SendFrame(dc, Frame{ID: id, Dir: dir, Kind: FrameEnd, Sequence: seq}, st)
+		}
+		if rerr != nil {
+			_ = SendFrame(dc, Frame{ID: id, Dir: dir, Kind: FrameRst, Payload: []byte(rerr.Error())}, st)
+			return rerr
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Package reverseproxy holds the header-handling conventions a
+// well-behaved HTTP reverse proxy is expected to follow: stripping
+// hop-by-hop headers before forwarding a request, and stamping
+// X-Forwarded-* headers so the upstream can see the original client. It
+// is shared by the gateway, which applies it to the request as it first
+// arrives from the client, and the endpoint, which applies it again
+// before the request leaves for the upstream service.
+package reverseproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders are connection-specific and must never be forwarded,
+// per RFC 7230 §6.1. Any header additionally named by the Connection
+// header itself is also stripped.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailers",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Policy configures how a hop rewrites headers when forwarding a
+// request toward its upstream.
+type Policy struct {
+	// PreserveHost keeps the original Host header on the outgoing
+	// request instead of replacing it with the upstream target's host.
+	PreserveHost bool
+	// Via, if set, is appended to the Via header to identify this hop.
+	Via string
+}
+
+// StripHopByHop removes hop-by-hop headers from h in place, including
+// any extra ones the Connection header names.
+func StripHopByHop(h http.Header) {
+	for _, f := range h.Values("Connection") {
+		for _, name := range strings.Split(f, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// appendCSV appends value to h's existing comma-separated header, or
+// sets it if the header isn't present yet. X-Forwarded-For and Via are
+// both meant to chain across hops this way.
+func appendCSV(h http.Header, key, value string) {
+	if value == "" {
+		return
+	}
+	if prior := h.Get(key); prior != "" {
+		h.Set(key, prior+", "+value)
+	} else {
+		h.Set(key, value)
+	}
+}
+
+// PrepareIngress strips hop-by-hop headers from h and stamps the
+// X-Forwarded-* headers a reverse proxy is expected to add, based on the
+// client's remote address and the request it arrived on. Call this as
+// soon as the original client request is seen, before it's forwarded
+// anywhere else.
+func PrepareIngress(h http.Header, remoteAddr, host, proto string, policy Policy) {
+	StripHopByHop(h)
+
+	clientIP := remoteAddr
+	if ip, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		clientIP = ip
+	}
+	appendCSV(h, "X-Forwarded-For", clientIP)
+	h.Set("X-Forwarded-Proto", proto)
+	h.Set("X-Forwarded-Host", host)
+	appendCSV(h, "Via", policy.Via)
+}
+
+// PrepareEgress strips hop-by-hop headers once more (in case this hop
+// re-added any) and points req at upstreamHost, unless policy.PreserveHost
+// keeps whatever Host the request already carries.
+func PrepareEgress(req *http.Request, upstreamHost string, policy Policy) {
+	StripHopByHop(req.Header)
+	appendCSV(req.Header, "Via", policy.Via)
+	if !policy.PreserveHost {
+		req.Host = upstreamHost
+	}
+}
@@ -0,0 +1,95 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestStripHopByHop(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "Keep-Alive, X-Custom-Hop")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("X-Custom-Hop", "drop-me")
+	h.Set("Content-Type", "text/plain")
+
+	StripHopByHop(h)
+
+	for _, name := range []string{"Connection", "Keep-Alive", "X-Custom-Hop"} {
+		if h.Get(name) != "" {
+			t.Errorf("header %q should have been stripped, got %q", name, h.Get(name))
+		}
+	}
+	if got := h.Get("Content-Type"); got != "text/plain" {
+		t.Errorf("Content-Type = %q, want unchanged", got)
+	}
+}
+
+func TestPrepareIngress_StampsForwardedHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "close")
+
+	PrepareIngress(h, "203.0.113.5:54321", "gateway.example", "https", Policy{Via: "1.1 gw"})
+
+	if got := h.Get("X-Forwarded-For"); got != "203.0.113.5" {
+		t.Errorf("X-Forwarded-For = %q, want %q", got, "203.0.113.5")
+	}
+	if got := h.Get("X-Forwarded-Proto"); got != "https" {
+		t.Errorf("X-Forwarded-Proto = %q, want https", got)
+	}
+	if got := h.Get("X-Forwarded-Host"); got != "gateway.example" {
+		t.Errorf("X-Forwarded-Host = %q, want gateway.example", got)
+	}
+	if got := h.Get("Via"); got != "1.1 gw" {
+		t.Errorf("Via = %q, want %q", got, "1.1 gw")
+	}
+	if h.Get("Connection") != "" {
+		t.Error("Connection header should have been stripped")
+	}
+}
+
+func TestPrepareIngress_ChainsViaAndForwardedFor(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Forwarded-For", "198.51.100.1")
+	h.Set("Via", "1.1 upstream-hop")
+
+	PrepareIngress(h, "203.0.113.5:1234", "gateway.example", "http", Policy{Via: "1.1 gw"})
+
+	if got := h.Get("X-Forwarded-For"); got != "198.51.100.1, 203.0.113.5" {
+		t.Errorf("X-Forwarded-For = %q, want chained value", got)
+	}
+	if got := h.Get("Via"); got != "1.1 upstream-hop, 1.1 gw" {
+		t.Errorf("Via = %q, want chained value", got)
+	}
+}
+
+func TestPrepareEgress_RewritesHostUnlessPreserved(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://gateway.example/", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Host = "gateway.example"
+	req.Header.Set("Connection", "keep-alive")
+
+	PrepareEgress(req, "upstream.internal:8080", Policy{})
+
+	if req.Host != "upstream.internal:8080" {
+		t.Errorf("Host = %q, want rewritten to upstream", req.Host)
+	}
+	if req.Header.Get("Connection") != "" {
+		t.Error("Connection header should have been stripped")
+	}
+}
+
+func TestPrepareEgress_PreservesHost(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://gateway.example/", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Host = "gateway.example"
+
+	PrepareEgress(req, "upstream.internal:8080", Policy{PreserveHost: true})
+
+	if req.Host != "gateway.example" {
+		t.Errorf("Host = %q, want preserved original host", req.Host)
+	}
+}
@@ -0,0 +1,156 @@
+// Package stats tracks lightweight per-peer traffic counters and
+// request-latency histograms, inspired by etcd's per-peer latency/min/max
+// stats. Every Counters field is an atomic, so instrumenting a hot path
+// never needs a lock; Registry looks peers up through a sync.Map, the
+// same lock-free map-of-state pattern gateway.Endpoint uses for its
+// responseStreams and the endpoint package uses for requestStreams.
+package stats
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBucketsMs are the upper bounds, in milliseconds, of every
+// histogram bucket but the last; everything slower falls into a final
+// +Inf bucket. numLatencyBuckets must be kept in sync with its length
+// since array sizes have to be constants.
+var latencyBucketsMs = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 5000}
+
+const numLatencyBuckets = 10
+
+// Histogram is a fixed-bucket request-latency histogram, safe for
+// concurrent use without a lock.
+type Histogram struct {
+	counts [numLatencyBuckets + 1]atomic.Uint64
+	sumNs  atomic.Uint64
+	n      atomic.Uint64
+}
+
+// Observe records one request's latency.
+func (h *Histogram) Observe(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	idx := len(latencyBucketsMs)
+	for i, bound := range latencyBucketsMs {
+		if ms <= bound {
+			idx = i
+			break
+		}
+	}
+	h.counts[idx].Add(1)
+	h.sumNs.Add(uint64(d.Nanoseconds()))
+	h.n.Add(1)
+}
+
+// HistogramSnapshot is a Histogram's state at a point in time. Buckets
+// are cumulative counts keyed by their upper bound in milliseconds
+// ("+Inf" for the overflow bucket), matching Prometheus histogram
+// semantics.
+type HistogramSnapshot struct {
+	Buckets map[string]uint64 `json:"buckets"`
+	Count   uint64            `json:"count"`
+	AvgMs   float64           `json:"avg_ms"`
+}
+
+func (h *Histogram) snapshot() HistogramSnapshot {
+	buckets := make(map[string]uint64, len(latencyBucketsMs)+1)
+	var cumulative uint64
+	for i, bound := range latencyBucketsMs {
+		cumulative += h.counts[i].Load()
+		buckets[fmt.Sprintf("%g", bound)] = cumulative
+	}
+	cumulative += h.counts[len(latencyBucketsMs)].Load()
+	buckets["+Inf"] = cumulative
+
+	n := h.n.Load()
+	var avg float64
+	if n > 0 {
+		avg = float64(h.sumNs.Load()) / float64(n) / float64(time.Millisecond)
+	}
+	return HistogramSnapshot{Buckets: buckets, Count: n, AvgMs: avg}
+}
+
+// Counters tracks traffic, backlog, and error counts for a single peer.
+// Every field is an atomic so Instrument call sites never need a lock.
+type Counters struct {
+	BytesSent       atomic.Uint64
+	BytesReceived   atomic.Uint64
+	PacketsSent     atomic.Uint64
+	PacketsReceived atomic.Uint64
+	InFlight        atomic.Int64
+	StreamDepth     atomic.Int64 // reassembly backlog of whichever of this peer's streams most recently received a DATA frame
+	Errors          atomic.Uint64
+	Latency         Histogram
+}
+
+// Snapshot is a Counters' state at a point in time: the JSON shape
+// returned by Registry.Snapshot and rendered by Registry.WritePrometheus.
+type Snapshot struct {
+	ID              string            `json:"id"`
+	BytesSent       uint64            `json:"bytes_sent"`
+	BytesReceived   uint64            `json:"bytes_received"`
+	PacketsSent     uint64            `json:"packets_sent"`
+	PacketsReceived uint64            `json:"packets_received"`
+	InFlight        int64             `json:"in_flight"`
+	StreamDepth     int64             `json:"stream_depth"`
+	Errors          uint64            `json:"errors"`
+	Latency         HistogramSnapshot `json:"latency"`
+}
+
+func (c *Counters) snapshot(id string) Snapshot {
+	return Snapshot{
+		ID:              id,
+		BytesSent:       c.BytesSent.Load(),
+		BytesReceived:   c.BytesReceived.Load(),
+		PacketsSent:     c.PacketsSent.Load(),
+		PacketsReceived: c.PacketsReceived.Load(),
+		InFlight:        c.InFlight.Load(),
+		StreamDepth:     c.StreamDepth.Load(),
+		Errors:          c.Errors.Load(),
+		Latency:         c.Latency.snapshot(),
+	}
+}
+
+// Registry is a lock-free set of per-peer Counters.
+type Registry struct {
+	peers sync.Map // map[string]*Counters
+}
+
+// Get returns the Counters for id, creating them on first use.
+func (r *Registry) Get(id string) *Counters {
+	v, _ := r.peers.LoadOrStore(id, &Counters{})
+	return v.(*Counters)
+}
+
+// Snapshot reports every known peer's counters, sorted by ID.
+func (r *Registry) Snapshot() []Snapshot {
+	var out []Snapshot
+	r.peers.Range(func(key, value any) bool {
+		out = append(out, value.(*Counters).snapshot(key.(string)))
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// WritePrometheus renders every peer's counters in Prometheus text
+// exposition format.
+func (r *Registry) WritePrometheus(w io.Writer) {
+	for _, s := range r.Snapshot() {
+		fmt.Fprintf(w, "restful_rtc_bytes_sent{peer=%q} %d\n", s.ID, s.BytesSent)
+		fmt.Fprintf(w, "restful_rtc_bytes_received{peer=%q} %d\n", s.ID, s.BytesReceived)
+		fmt.Fprintf(w, "restful_rtc_packets_sent{peer=%q} %d\n", s.ID, s.PacketsSent)
+		fmt.Fprintf(w, "restful_rtc_packets_received{peer=%q} %d\n", s.ID, s.PacketsReceived)
+		fmt.Fprintf(w, "restful_rtc_in_flight{peer=%q} %d\n", s.ID, s.InFlight)
+		fmt.Fprintf(w, "restful_rtc_stream_depth{peer=%q} %d\n", s.ID, s.StreamDepth)
+		fmt.Fprintf(w, "restful_rtc_errors_total{peer=%q} %d\n", s.ID, s.Errors)
+		fmt.Fprintf(w, "restful_rtc_request_latency_avg_ms{peer=%q} %g\n", s.ID, s.Latency.AvgMs)
+		for bound, count := range s.Latency.Buckets {
+			fmt.Fprintf(w, "restful_rtc_request_latency_bucket{peer=%q,le=%q} %d\n", s.ID, bound, count)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+// TestNumLatencyBucketsMatchesBounds guards the invariant latencyBucketsMs's
+// doc comment calls out: the array bound has to be a literal constant, so
+// nothing enforces at compile time that it still matches
+// len(latencyBucketsMs) once someone edits one without the other.
+func TestNumLatencyBucketsMatchesBounds(t *testing.T) {
+	if numLatencyBuckets != len(latencyBucketsMs) {
+		t.Fatalf("numLatencyBuckets = %d, want %d (len(latencyBucketsMs)); keep them in sync", numLatencyBuckets, len(latencyBucketsMs))
+	}
+}
+
+func TestHistogram_ObserveAndSnapshot(t *testing.T) {
+	var h Histogram
+	h.Observe(3 * time.Millisecond)
+	h.Observe(30 * time.Millisecond)
+	h.Observe(10 * time.Second) // overflow bucket
+
+	snap := h.snapshot()
+	if snap.Count != 3 {
+		t.Fatalf("Count = %d, want 3", snap.Count)
+	}
+	if snap.Buckets["5"] != 1 {
+		t.Errorf(`Buckets["5"] = %d, want 1 (the 3ms observation)`, snap.Buckets["5"])
+	}
+	if snap.Buckets["+Inf"] != 3 {
+		t.Errorf(`Buckets["+Inf"] = %d, want 3 (cumulative, includes the 10s outlier)`, snap.Buckets["+Inf"])
+	}
+}
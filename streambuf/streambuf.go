@@ -0,0 +1,160 @@
+// Package streambuf reassembles an ordered sequence of body chunks
+// arriving as individually-sized frames into a stream consumers can read
+// incrementally, instead of buffering the whole body before any
+// consumer sees a byte of it. It is shared by the gateway and endpoint
+// so both sides of a streamed request/response use the same windowed
+// reordering and backpressure behavior.
+package streambuf
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Window bounds how far ahead of the next expected sequence number a
+// frame may arrive before it's rejected as out of range. The underlying
+// PeerJS data channel is ordered and reliable, so frames should arrive
+// in sequence in practice; the window only guards against a
+// misbehaving peer or protocol bug silently growing memory forever.
+const Window = 64
+
+// StreamBuffer reorders DATA frames for a single request/response body
+// and exposes them as an ordered channel of chunks. Pushing a frame
+// blocks until the consumer has drained the previous chunk, so a slow
+// reader applies backpressure all the way back to the peer connection.
+type StreamBuffer struct {
+	mu      sync.Mutex
+	nextSeq int
+	pending map[int][]byte
+	done    bool
+	err     error
+
+	chunks    chan []byte
+	closed    chan struct{}  // closed by close() to unblock a Push stuck mid-send
+	sendingWG sync.WaitGroup // counts Push calls that may still be sending on chunks
+}
+
+// New returns an empty StreamBuffer ready to accept frames starting at
+// sequence 0.
+func New() *StreamBuffer {
+	return &StreamBuffer{
+		pending: make(map[int][]byte),
+		chunks:  make(chan []byte),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Push feeds a DATA frame's payload in at sequence seq. Frames that
+// arrive earlier than expected are held in the reorder window until the
+// gap is filled; frames already seen are silently dropped as duplicates.
+// Push blocks while flushing in-order chunks until the consumer (ranging
+// over Chunks) has read each one, which is the backpressure mechanism —
+// unless End/Reset is called concurrently (e.g. by a TTL eviction), in
+// which case a send still blocked on a stalled consumer is abandoned
+// instead of racing close() on the Chunks channel. sendingWG is
+// incremented under the same lock as the done check so close() can
+// never start waiting on it before every Push that's committed to
+// sending has registered — see close() for why that ordering matters.
+func (sb *StreamBuffer) Push(seq int, payload []byte) error {
+	sb.mu.Lock()
+	if sb.done {
+		sb.mu.Unlock()
+		return fmt.Errorf("streambuf: push after End/Reset")
+	}
+	if seq < sb.nextSeq {
+		sb.mu.Unlock()
+		return nil // duplicate of an already-flushed frame
+	}
+	if seq-sb.nextSeq >= Window {
+		sb.mu.Unlock()
+		return fmt.Errorf("streambuf: frame %d outside reorder window (next=%d)", seq, sb.nextSeq)
+	}
+	sb.pending[seq] = payload
+
+	var ready [][]byte
+	for {
+		chunk, ok := sb.pending[sb.nextSeq]
+		if !ok {
+			break
+		}
+		delete(sb.pending, sb.nextSeq)
+		ready = append(ready, chunk)
+		sb.nextSeq++
+	}
+	sb.sendingWG.Add(1)
+	sb.mu.Unlock()
+	defer sb.sendingWG.Done()
+
+	for _, chunk := range ready {
+		select {
+		case sb.chunks <- chunk:
+		case <-sb.closed:
+			return nil
+		}
+	}
+	return nil
+}
+
+// End marks the stream as cleanly finished; Chunks() closes once any
+// already-pushed chunks have been drained.
+func (sb *StreamBuffer) End() {
+	sb.close(nil)
+}
+
+// Reset aborts the stream with err; Err() reports it once Chunks()
+// closes.
+func (sb *StreamBuffer) Reset(err error) {
+	if err == nil {
+		err = fmt.Errorf("streambuf: reset")
+	}
+	sb.close(err)
+}
+
+// close marks the stream done and arranges for chunks to be closed.
+// Closing chunks directly here would race any Push still inside its
+// send loop, so instead: wake every blocked Push via closed (so none
+// stays parked forever), then let a dedicated goroutine wait for every
+// Push that had already committed to sending (sendingWG) to finish
+// before it closes chunks. The done flag guarantees this body runs at
+// most once, and the Add in Push sharing this same lock guarantees
+// sendingWG.Wait below never starts before every such Push has
+// registered.
+func (sb *StreamBuffer) close(err error) {
+	sb.mu.Lock()
+	if sb.done {
+		sb.mu.Unlock()
+		return
+	}
+	sb.done = true
+	sb.err = err
+	sb.mu.Unlock()
+	close(sb.closed) // wakes any Push blocked sending
+	go func() {
+		sb.sendingWG.Wait()
+		close(sb.chunks)
+	}()
+}
+
+// Pending reports how many out-of-order chunks are currently buffered
+// waiting for a gap to close. Intended for stats/diagnostics, not flow
+// control.
+func (sb *StreamBuffer) Pending() int {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return len(sb.pending)
+}
+
+// Chunks returns the ordered channel of body chunks. It closes once End
+// or Reset has been called and every in-order chunk has been delivered.
+func (sb *StreamBuffer) Chunks() <-chan []byte {
+	return sb.chunks
+}
+
+// Err reports why the stream ended. It is only meaningful after Chunks()
+// has been drained (closed); nil means End was called, non-nil means
+// Reset was called with that error.
+func (sb *StreamBuffer) Err() error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.err
+}
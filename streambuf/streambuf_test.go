@@ -0,0 +1,76 @@
+package streambuf
+
+import (
+	"testing"
+	"time"
+)
+
+// TestPush_BlockedSendDuringReset reproduces the TTL-janitor hazard: a
+// Push is blocked handing an in-order chunk to a consumer that never
+// drains it, while Reset (e.g. from an eviction sweep) closes the
+// stream concurrently. Push must give up cleanly instead of racing
+// close() on the chunks channel.
+func TestPush_BlockedSendDuringReset(t *testing.T) {
+	sb := New()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sb.Push(0, []byte("chunk"))
+	}()
+
+	// Give Push a chance to reach its blocked send before evicting.
+	time.Sleep(10 * time.Millisecond)
+	sb.Reset(nil)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Push returned unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Push did not return after Reset; likely deadlocked or panicked")
+	}
+
+	if _, ok := <-sb.Chunks(); ok {
+		t.Fatal("Chunks() should be closed with no chunk delivered after Reset")
+	}
+	if sb.Err() == nil {
+		t.Fatal("Err() should report the reset error")
+	}
+}
+
+func TestPush_OutOfOrderReassembly(t *testing.T) {
+	sb := New()
+
+	if err := sb.Push(1, []byte("b")); err != nil {
+		t.Fatalf("Push(1): %v", err)
+	}
+	if got := sb.Pending(); got != 1 {
+		t.Fatalf("Pending() = %d, want 1", got)
+	}
+
+	go func() {
+		sb.Push(0, []byte("a"))
+		sb.Push(2, []byte("c"))
+		sb.End()
+	}()
+
+	var got []byte
+	for chunk := range sb.Chunks() {
+		got = append(got, chunk...)
+	}
+	if string(got) != "abc" {
+		t.Fatalf("reassembled = %q, want %q", got, "abc")
+	}
+	if sb.Err() != nil {
+		t.Fatalf("Err() = %v, want nil after End", sb.Err())
+	}
+}
+
+func TestPush_AfterEndIsRejected(t *testing.T) {
+	sb := New()
+	sb.End()
+	if err := sb.Push(0, []byte("late")); err == nil {
+		t.Fatal("Push after End should return an error")
+	}
+}